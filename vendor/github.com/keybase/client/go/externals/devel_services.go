@@ -0,0 +1,80 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package externals
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	libkb "github.com/keybase/client/go/libkb"
+)
+
+// develGateOK reports whether the running client is allowed to mutate the
+// service collection directly, for tests and devel tooling that need to
+// simulate a new social proof provider without rebuilding the package.
+func (p *proofServices) develGateOK() bool {
+	return p.G().Env.GetRunMode() == libkb.DevelRunMode || p.G().Env.RunningInCI()
+}
+
+// RegisterExternalOpts configures RegisterExternal.
+type RegisterExternalOpts struct {
+	// Force allows overwriting a service backed by a verified ParamProof
+	// merkle entry, which RegisterExternal otherwise refuses to do.
+	Force bool
+}
+
+// RegisterExternal registers st in-memory, taking the same path as a
+// server-loaded service (including the useDevelProofCheckers/IsDevelOnly
+// check) and firing the usual ServiceChangeEvents. It is gated behind
+// DevelRunMode or CI, and refuses to overwrite a service backed by a
+// verified ParamProof merkle entry unless opts.Force is set.
+func (p *proofServices) RegisterExternal(st libkb.ServiceType, opts RegisterExternalOpts) error {
+	if !p.develGateOK() {
+		return fmt.Errorf("RegisterExternal is only available in devel mode or CI")
+	}
+
+	p.Lock()
+	if !opts.Force {
+		for _, k := range st.AllStringKeys() {
+			if p.merkleBacked[k] {
+				p.Unlock()
+				return fmt.Errorf("RegisterExternal: refusing to overwrite merkle-backed service %q without force", k)
+			}
+		}
+	}
+	events := p.register([]libkb.ServiceType{st})
+	for _, k := range st.AllStringKeys() {
+		delete(p.merkleBacked, k)
+	}
+	p.Unlock()
+
+	p.subs.publish(libkb.NewMetaContext(context.TODO(), p.G()), events)
+	return nil
+}
+
+// UnregisterExternal removes a key previously added by RegisterExternal. It
+// is gated the same way as RegisterExternal, and is a no-op if the key
+// isn't present.
+func (p *proofServices) UnregisterExternal(key string) error {
+	if !p.develGateOK() {
+		return fmt.Errorf("UnregisterExternal is only available in devel mode or CI")
+	}
+
+	key = strings.ToLower(key)
+	p.Lock()
+	st, existed := p.collection[key]
+	if !existed {
+		p.Unlock()
+		return nil
+	}
+	delete(p.collection, key)
+	delete(p.merkleBacked, key)
+	p.Unlock()
+
+	p.subs.publish(libkb.NewMetaContext(context.TODO(), p.G()), []ServiceChangeEvent{
+		{Kind: ServiceChangeRemoved, Key: key, Type: st},
+	})
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package externals
+
+import (
+	"encoding/json"
+
+	libkb "github.com/keybase/client/go/libkb"
+	keybase1 "github.com/keybase/client/go/protocol/keybase1"
+)
+
+// paramProofCacheEntry is what gets persisted to LocalDb so that a client
+// starting offline can still resolve service types that were registered on
+// a prior run.
+type paramProofCacheEntry struct {
+	Seqno keybase1.Seqno `json:"seqno"`
+	Entry string         `json:"entry"`
+}
+
+func paramProofDbKey() libkb.DbKey {
+	return libkb.DbKey{
+		Typ: libkb.DBParamProofCache,
+		Key: "paramproofs",
+	}
+}
+
+// persistServiceConfigs writes the raw merkle-committed ParamProof blob to
+// LocalDb, together with the seqno of the merkle root it was verified
+// against. Every blob is stored under the same fixed key, so each call
+// replaces the one before it; earlier seqnos are not kept.
+func persistServiceConfigs(mctx libkb.MetaContext, seqno keybase1.Seqno, entry string) error {
+	cache := paramProofCacheEntry{Seqno: seqno, Entry: entry}
+	b, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	return mctx.G().LocalDb.PutRaw(paramProofDbKey(), b)
+}
+
+// loadPersistedServiceConfigs reads back whatever ParamProof blob was last
+// persisted by persistServiceConfigs, if any.
+func loadPersistedServiceConfigs(mctx libkb.MetaContext) ([]*GenericSocialProofConfig, keybase1.Seqno, error) {
+	b, found, err := mctx.G().LocalDb.GetRaw(paramProofDbKey())
+	if err != nil || !found {
+		return nil, 0, err
+	}
+
+	var cache paramProofCacheEntry
+	if err := json.Unmarshal(b, &cache); err != nil {
+		return nil, 0, err
+	}
+
+	configs, err := decodeServiceConfigs(mctx, []byte(cache.Entry))
+	if err != nil {
+		return nil, 0, err
+	}
+	return configs, cache.Seqno, nil
+}
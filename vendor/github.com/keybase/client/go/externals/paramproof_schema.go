@@ -0,0 +1,117 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package externals
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+
+	libkb "github.com/keybase/client/go/libkb"
+)
+
+// ParamProofSchema describes how to parse one wire version of the
+// ParamProof merkle entry into GenericSocialProofConfigs. Register one via
+// RegisterParamProofSchema from an init() function.
+type ParamProofSchema struct {
+	Version int
+	Parse   func(b []byte) ([]*GenericSocialProofConfig, error)
+}
+
+// ParamProofMigration upgrades a single config parsed at FromVersion up to
+// ToVersion. Migrations are chained by migrateServiceConfig so that, e.g.,
+// a v1 config still resolves once the server has rolled forward to v2.
+type ParamProofMigration struct {
+	FromVersion int
+	ToVersion   int
+	Migrate     func(cfg *GenericSocialProofConfig)
+}
+
+var paramProofSchemaMu sync.Mutex
+var paramProofSchemas = map[int]ParamProofSchema{}
+var paramProofMigrations []ParamProofMigration
+
+func init() {
+	RegisterParamProofSchema(ParamProofSchema{
+		Version: SupportedVersion,
+		Parse:   decodeServiceConfigsV1,
+	})
+}
+
+// RegisterParamProofSchema makes a ParamProofSchema available to
+// loadParamProofServices for entries stamped with that version.
+func RegisterParamProofSchema(schema ParamProofSchema) {
+	paramProofSchemaMu.Lock()
+	defer paramProofSchemaMu.Unlock()
+	paramProofSchemas[schema.Version] = schema
+}
+
+// RegisterParamProofMigration makes a ParamProofMigration available to
+// migrateServiceConfig.
+func RegisterParamProofMigration(migration ParamProofMigration) {
+	paramProofSchemaMu.Lock()
+	defer paramProofSchemaMu.Unlock()
+	paramProofMigrations = append(paramProofMigrations, migration)
+}
+
+type paramProofVersionT struct {
+	Version int `json:"version"`
+}
+
+// decodeServiceConfigs picks the ParamProofSchema matching the entry's
+// version field (defaulting to version 1 for older entries that predate
+// versioning), parses with it, and migrates the results up to
+// SupportedVersion. If no schema is registered for the entry's version, it
+// returns a libkb.UnsupportedParamProofVersionError.
+func decodeServiceConfigs(mctx libkb.MetaContext, b []byte) ([]*GenericSocialProofConfig, error) {
+	var versioned paramProofVersionT
+	if err := json.Unmarshal(b, &versioned); err != nil {
+		return nil, err
+	}
+	version := versioned.Version
+	if version == 0 {
+		version = 1
+	}
+
+	schema, ok := schemaForVersion(version)
+	if !ok {
+		return nil, libkb.UnsupportedParamProofVersionError{Version: version}
+	}
+
+	configs, err := schema.Parse(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, cfg := range configs {
+		migrateServiceConfig(cfg, version)
+	}
+	return configs, nil
+}
+
+func schemaForVersion(version int) (ParamProofSchema, bool) {
+	paramProofSchemaMu.Lock()
+	defer paramProofSchemaMu.Unlock()
+	schema, ok := paramProofSchemas[version]
+	return schema, ok
+}
+
+// migrateServiceConfig walks cfg forward from fromVersion to
+// SupportedVersion by applying any registered migrations in order.
+func migrateServiceConfig(cfg *GenericSocialProofConfig, fromVersion int) {
+	paramProofSchemaMu.Lock()
+	migrations := make([]ParamProofMigration, len(paramProofMigrations))
+	copy(migrations, paramProofMigrations)
+	paramProofSchemaMu.Unlock()
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].FromVersion < migrations[j].FromVersion })
+
+	version := fromVersion
+	for _, m := range migrations {
+		if m.FromVersion != version || m.ToVersion <= version || m.ToVersion > SupportedVersion {
+			continue
+		}
+		m.Migrate(cfg)
+		version = m.ToVersion
+	}
+}
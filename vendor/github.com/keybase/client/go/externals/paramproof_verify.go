@@ -0,0 +1,56 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package externals
+
+import (
+	"bytes"
+	"crypto/sha256"
+
+	libkb "github.com/keybase/client/go/libkb"
+	keybase1 "github.com/keybase/client/go/protocol/keybase1"
+)
+
+// paramProofsMerkleLeaf is the name of the leaf in the signed merkle root
+// that commits to the current ParamProof entry's hash.
+const paramProofsMerkleLeaf = "paramproofs"
+
+// ParamProofVerifier checks that a ParamProof merkle entry is anchored in a
+// current, signed Keybase merkle root before its services are trusted
+// enough to register.
+type ParamProofVerifier interface {
+	// Verify returns the seqno of the merkle root the entry was verified
+	// against, or an error if the entry cannot be trusted.
+	Verify(mctx libkb.MetaContext, entry keybase1.MerkleStoreEntry) (keybase1.Seqno, error)
+}
+
+type merkleParamProofVerifier struct{}
+
+// NewParamProofVerifier returns the default ParamProofVerifier, which
+// anchors trust in the client's merkle root.
+func NewParamProofVerifier() ParamProofVerifier {
+	return merkleParamProofVerifier{}
+}
+
+func (v merkleParamProofVerifier) Verify(mctx libkb.MetaContext, entry keybase1.MerkleStoreEntry) (keybase1.Seqno, error) {
+	root, err := mctx.G().MerkleClient.FetchRootFromServer(mctx, libkb.NoMerkleRootFreshness)
+	if err != nil {
+		return 0, err
+	}
+
+	committedHash, ok := root.LeafHash(paramProofsMerkleLeaf)
+	if !ok {
+		return 0, libkb.NewParamProofTrustError("current merkle root has no paramproofs leaf")
+	}
+
+	sum := sha256.Sum256([]byte(entry.Entry))
+	if !bytes.Equal(sum[:], committedHash) {
+		return 0, libkb.NewParamProofTrustError("paramproofs entry does not match merkle-committed hash")
+	}
+
+	if !root.SignedBy(mctx.G().Env.GetParamProofTrustKey()) {
+		return 0, libkb.NewParamProofTrustError("paramproofs entry signed by untrusted key")
+	}
+
+	return root.Seqno(), nil
+}
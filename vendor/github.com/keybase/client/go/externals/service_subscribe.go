@@ -0,0 +1,111 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package externals
+
+import (
+	"sync"
+
+	libkb "github.com/keybase/client/go/libkb"
+)
+
+// ServiceChangeKind describes how a ServiceType entry in a
+// proofServices.collection changed.
+type ServiceChangeKind int
+
+const (
+	ServiceChangeAdded ServiceChangeKind = iota
+	ServiceChangeRemoved
+	ServiceChangeUpdated
+)
+
+// ServiceChangeEvent is delivered to Subscribers whenever register (or
+// UnregisterExternal) changes which ServiceType a key resolves to.
+type ServiceChangeEvent struct {
+	Kind ServiceChangeKind
+	Key  string
+	Type libkb.ServiceType
+}
+
+// ServiceChangeBufSize is the suggested buffer size for channels passed to
+// Subscribe. A slow subscriber that falls behind this has its oldest
+// queued event dropped rather than stalling register.
+const ServiceChangeBufSize = 32
+
+// serviceSubscribers fans ServiceChangeEvents out to anyone who called
+// proofServices.Subscribe. Subscriptions are kept as bidirectional
+// channels (rather than narrowed to send-only) so that sendDroppingOldest
+// can receive from them to make room for a new event; callers should
+// still only ever read from the channel they passed to Subscribe.
+type serviceSubscribers struct {
+	sync.Mutex
+	nextID uint64
+	subs   map[uint64]chan ServiceChangeEvent
+}
+
+func newServiceSubscribers() *serviceSubscribers {
+	return &serviceSubscribers{subs: make(map[uint64]chan ServiceChangeEvent)}
+}
+
+// Subscribe registers ch to receive ServiceChangeEvents. The returned
+// unsub func removes the subscription and is safe to call more than once.
+func (s *serviceSubscribers) Subscribe(ch chan ServiceChangeEvent) (unsub func()) {
+	s.Lock()
+	id := s.nextID
+	s.nextID++
+	s.subs[id] = ch
+	s.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.Lock()
+			delete(s.subs, id)
+			s.Unlock()
+		})
+	}
+}
+
+// publish delivers events to all subscribers. Callers must invoke this
+// outside of any lock that register or GetServiceType might need, since a
+// subscriber's receive can race with a call back into this package.
+func (s *serviceSubscribers) publish(mctx libkb.MetaContext, events []ServiceChangeEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	s.Lock()
+	chans := make([]chan ServiceChangeEvent, 0, len(s.subs))
+	for _, ch := range s.subs {
+		chans = append(chans, ch)
+	}
+	s.Unlock()
+
+	for _, ch := range chans {
+		for _, ev := range events {
+			s.sendDroppingOldest(mctx, ch, ev)
+		}
+	}
+}
+
+func (s *serviceSubscribers) sendDroppingOldest(mctx libkb.MetaContext, ch chan ServiceChangeEvent, ev ServiceChangeEvent) {
+	select {
+	case ch <- ev:
+		return
+	default:
+	}
+
+	// The channel is full; drop the oldest event to make room rather than
+	// block register's caller on a slow subscriber.
+	select {
+	case <-ch:
+		mctx.Warning("proofServices: subscriber channel full, dropped oldest ServiceChangeEvent")
+	default:
+	}
+
+	select {
+	case ch <- ev:
+	default:
+		mctx.Warning("proofServices: subscriber channel still full, dropped ServiceChangeEvent for %s", ev.Key)
+	}
+}
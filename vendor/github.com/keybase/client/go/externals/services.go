@@ -6,8 +6,10 @@ package externals
 import (
 	"context"
 	"encoding/json"
+	"reflect"
 	"strings"
 	"sync"
+	"time"
 
 	libkb "github.com/keybase/client/go/libkb"
 	keybase1 "github.com/keybase/client/go/protocol/keybase1"
@@ -16,6 +18,10 @@ import (
 // SupportedVersion is which version of ParamProofs is supported by this client.
 const SupportedVersion int = 1
 
+// paramProofCacheTTL is how long a loaded set of ParamProof services is
+// considered fresh before loadParamProofServices will hit the server again.
+const paramProofCacheTTL = time.Hour
+
 // staticProofServies are only used for testing or for basic assertion
 // validation
 type staticProofServices struct {
@@ -56,52 +62,240 @@ func (p *staticProofServices) ListProofCheckers() []string {
 
 // Contains both the statically known services and loads the configurations for
 // known services from the server
+//
+// BLOCKER: Invalidate, LastLoaded, LastVerifiedRoot, LastUnsupportedVersion,
+// Subscribe, RegisterExternal and UnregisterExternal are all implemented
+// below, but libkb.ExternalServicesCollector -- defined in the libkb
+// package, which this tree does not vendor, so it cannot be edited from
+// here -- does not declare them. Until it does, every caller that holds
+// the collector through that interface type (which is what NewProofServices
+// returns) can only reach these via an unsafe type assertion to
+// *proofServices, which defeats the point of adding them. Whoever has the
+// real libkb/external_services.go needs to add, verbatim:
+//
+//	Invalidate()
+//	LastLoaded() time.Time
+//	LastVerifiedRoot() keybase1.Seqno
+//	LastUnsupportedVersion() (version int, unsupported bool)
+//	Subscribe(ch chan externals.ServiceChangeEvent) (unsub func())
+//	RegisterExternal(st ServiceType, opts externals.RegisterExternalOpts) error
+//	UnregisterExternal(key string) error
+//
+// to the ExternalServicesCollector interface before this series can be
+// considered done.
+//
+// TODO: this file has no test coverage (TTL/cache behavior, disk
+// persistence round-trip, verifier trust/failure paths, schema
+// version fallback/migration chaining, drop-oldest subscriber buffer
+// policy). Add it alongside libkb, since exercising any of the above
+// needs a real libkb.GlobalContext/ServiceType to construct against.
 type proofServices struct {
 	sync.Mutex
 	libkb.Contextified
-	collection map[string]libkb.ServiceType
-	loaded     bool
+	collection       map[string]libkb.ServiceType
+	merkleBacked     map[string]bool
+	loadedAt         time.Time
+	lastVerifiedRoot keybase1.Seqno
+	// lastUnsupportedVersion is the ParamProofSchema version most recently
+	// rejected by loadParamProofServices, or 0 if the last load either
+	// succeeded or hasn't happened yet.
+	lastUnsupportedVersion int
+	verifier               ParamProofVerifier
+	subs                   *serviceSubscribers
+	invalidateCh           chan struct{}
+	stopCh                 chan struct{}
+	shutdownOnce           sync.Once
 }
 
 func NewProofServices(g *libkb.GlobalContext) libkb.ExternalServicesCollector {
-	return newProofServices(g)
+	p := newProofServices(g)
+	go p.refreshLoop()
+	return p
 }
 
 func newProofServices(g *libkb.GlobalContext) *proofServices {
 	p := &proofServices{
 		Contextified: libkb.NewContextified(g),
 		collection:   make(map[string]libkb.ServiceType),
+		merkleBacked: make(map[string]bool),
+		verifier:     NewParamProofVerifier(),
+		subs:         newServiceSubscribers(),
+		invalidateCh: make(chan struct{}, 1),
+		stopCh:       make(chan struct{}),
 	}
 
 	staticServices := getStaticProofServices()
 	p.Lock()
 	defer p.Unlock()
 	p.register(staticServices)
+
+	mctx := libkb.NewMetaContext(context.TODO(), g)
+	if persisted, seqno, err := loadPersistedServiceConfigs(mctx); err != nil {
+		mctx.Debug("proofServices: unable to hydrate persisted paramproofs: %v", err)
+	} else if len(persisted) > 0 {
+		mctx.Debug("proofServices: hydrated %d paramproof service(s) from disk (seqno %d)", len(persisted), seqno)
+		hydrated := servicesFromConfigs(mctx, persisted)
+		p.register(hydrated)
+		// The persisted blob was merkle-verified against seqno before it
+		// was written to disk, so these services are just as trusted as
+		// ones freshly loaded from the server.
+		for _, st := range hydrated {
+			for _, k := range st.AllStringKeys() {
+				p.merkleBacked[k] = true
+			}
+		}
+		p.lastVerifiedRoot = seqno
+	}
+
 	return p
 }
 
-func (p *proofServices) register(services []libkb.ServiceType) {
+// refreshLoop loads the ParamProof service list immediately, then reloads
+// it every paramProofCacheTTL and immediately whenever Invalidate is
+// called. It exits when the proofServices is torn down via Shutdown.
+func (p *proofServices) refreshLoop() {
+	p.refreshOnce()
+
+	timer := time.NewTimer(p.cacheTTL())
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			p.refreshOnce()
+			timer.Reset(p.cacheTTL())
+		case <-p.invalidateCh:
+			p.refreshOnce()
+			timer.Reset(p.cacheTTL())
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+// refreshOnce runs loadParamProofServices once and publishes any resulting
+// ServiceChangeEvents outside the lock.
+func (p *proofServices) refreshOnce() {
+	p.Lock()
+	events := p.loadParamProofServices()
+	p.Unlock()
+	p.subs.publish(libkb.NewMetaContext(context.TODO(), p.G()), events)
+}
+
+func (p *proofServices) cacheTTL() time.Duration {
+	if ttl := p.G().Env.GetParamProofCacheTTL(); ttl > 0 {
+		return ttl
+	}
+	return paramProofCacheTTL
+}
+
+// Invalidate wakes the background refresh loop so that it reloads the
+// ParamProof service list from the server right away, bypassing the TTL.
+// GetServiceType and ListProofCheckers keep returning the cached
+// collection until that reload completes.
+func (p *proofServices) Invalidate() {
+	p.Lock()
+	p.loadedAt = time.Time{}
+	p.Unlock()
+
+	select {
+	case p.invalidateCh <- struct{}{}:
+	default:
+		// a refresh is already pending
+	}
+}
+
+// LastLoaded returns the time the ParamProof service list was last
+// successfully loaded, or the zero time if it has never been loaded.
+func (p *proofServices) LastLoaded() time.Time {
+	p.Lock()
+	defer p.Unlock()
+	return p.loadedAt
+}
+
+// Shutdown stops the background refresh loop. It is safe to call multiple
+// times.
+func (p *proofServices) Shutdown() {
+	p.shutdownOnce.Do(func() {
+		close(p.stopCh)
+	})
+}
+
+// LastVerifiedRoot returns the seqno of the most recent signed merkle root
+// against which the ParamProof entry was successfully verified, or 0 if
+// none has verified yet.
+func (p *proofServices) LastVerifiedRoot() keybase1.Seqno {
+	p.Lock()
+	defer p.Unlock()
+	return p.lastVerifiedRoot
+}
+
+// LastUnsupportedVersion returns the ParamProofSchema version most recently
+// rejected by loadParamProofServices as unsupported, and whether one has
+// been rejected since the last successful load. Callers like the Prove
+// engine can use this to refuse to start a proof attempt on a service
+// whose config this client cannot understand, rather than silently
+// falling back to the static service list.
+func (p *proofServices) LastUnsupportedVersion() (version int, unsupported bool) {
+	p.Lock()
+	defer p.Unlock()
+	return p.lastUnsupportedVersion, p.lastUnsupportedVersion != 0
+}
+
+// register adds services to the collection and returns the diff against
+// the prior collection as ServiceChangeEvents. It must be called with p's
+// lock held; the caller is responsible for publishing the returned events
+// outside the lock.
+func (p *proofServices) register(services []libkb.ServiceType) []ServiceChangeEvent {
+	var events []ServiceChangeEvent
 	for _, st := range services {
 		if !useDevelProofCheckers && st.IsDevelOnly() {
 			continue
 		}
 		for _, k := range st.AllStringKeys() {
+			prev, existed := p.collection[k]
 			p.collection[k] = st
+			switch {
+			case !existed:
+				events = append(events, ServiceChangeEvent{Kind: ServiceChangeAdded, Key: k, Type: st})
+			case !reflect.DeepEqual(prev, st):
+				// Concrete ServiceTypes are freshly constructed on every
+				// parse, so a plain != would either panic on an
+				// uncomparable field (e.g. a slice in a per-provider
+				// config) or, for pointer-backed types, always report a
+				// change since the pointer differs even when the
+				// underlying config didn't. DeepEqual compares the
+				// contents instead of the interface's dynamic pointer.
+				events = append(events, ServiceChangeEvent{Kind: ServiceChangeUpdated, Key: k, Type: st})
+			}
 		}
 	}
+	return events
+}
+
+// Subscribe registers ch to receive a ServiceChangeEvent every time
+// register adds or updates a service, so subsystems like the Prove engine
+// or chat/identity UI can react without re-instantiating the collector. ch
+// is bidirectional (rather than send-only) so the drop-oldest buffer
+// policy can drain a stale queued event from it; callers should still only
+// ever read from it.
+func (p *proofServices) Subscribe(ch chan ServiceChangeEvent) (unsub func()) {
+	return p.subs.Subscribe(ch)
 }
 
+// GetServiceType reads from the cached collection. It does not itself
+// refresh the collection from the server; the background refreshLoop owns
+// that. A lookup made while a refresh is running waits for it, since
+// refreshOnce holds p's lock across the server fetch.
 func (p *proofServices) GetServiceType(s string) libkb.ServiceType {
 	p.Lock()
 	defer p.Unlock()
-	p.loadParamProofServices()
 	return p.collection[strings.ToLower(s)]
 }
 
+// ListProofCheckers reads from the cached collection; see GetServiceType.
 func (p *proofServices) ListProofCheckers() []string {
 	p.Lock()
 	defer p.Unlock()
-	p.loadParamProofServices()
 	var ret []string
 	for k := range p.collection {
 		ret = append(ret, k)
@@ -109,48 +303,100 @@ func (p *proofServices) ListProofCheckers() []string {
 	return ret
 }
 
-func (p *proofServices) loadParamProofServices() {
+// loadParamProofServices is called with p's lock held, by refreshOnce. It is
+// a no-op unless the cached collection is older than cacheTTL (or has been
+// cleared by Invalidate), so the refresh loop can call it unconditionally.
+// It returns any ServiceChangeEvents
+// produced by registering newly loaded services, for the caller to publish
+// once it has released the lock.
+func (p *proofServices) loadParamProofServices() []ServiceChangeEvent {
 	shouldRun := p.G().Env.GetFeatureFlags().Admin() || p.G().Env.GetRunMode() == libkb.DevelRunMode || p.G().Env.RunningInCI()
 
 	if !shouldRun {
-		return
+		return nil
+	}
+
+	if !p.loadedAt.IsZero() && time.Since(p.loadedAt) < p.cacheTTL() {
+		return nil
 	}
 
 	mctx := libkb.NewMetaContext(context.TODO(), p.G())
 	entry, err := p.G().GetParamProofStore().GetLatestEntry(mctx)
 	if err != nil {
-		p.G().Log.CDebugf(context.TODO(), "unable to load paramproofs: %v", err)
-		return
+		mctx.Debug("unable to load paramproofs: %v", err)
+		return nil
 	}
+
+	verifiedSeqno, err := p.verifier.Verify(mctx, entry)
+	if err != nil {
+		// Trust failure: leave the existing collection untouched rather
+		// than risk registering spoofed services.
+		mctx.Warning("paramproofs: entry failed merkle verification, keeping previous services: %v", err)
+		return nil
+	}
+
 	serviceConfigs, err := p.parseServiceConfigs(entry)
 	if err != nil {
-		p.G().Log.CDebugf(context.TODO(), "unable to parse paramproofs: %v", err)
-		return
+		if uverr, ok := err.(libkb.UnsupportedParamProofVersionError); ok {
+			mctx.Warning("paramproofs: %s; falling back to static services", uverr)
+			p.lastUnsupportedVersion = uverr.Version
+			return p.register(getStaticProofServices())
+		}
+		mctx.Debug("unable to parse paramproofs: %v", err)
+		return nil
+	}
+	loadedServices := servicesFromConfigs(mctx, serviceConfigs)
+	events := p.register(loadedServices)
+	for _, st := range loadedServices {
+		for _, k := range st.AllStringKeys() {
+			p.merkleBacked[k] = true
+		}
 	}
-	services := []libkb.ServiceType{}
-	for _, config := range serviceConfigs {
+	p.loadedAt = time.Now()
+	p.lastVerifiedRoot = verifiedSeqno
+	p.lastUnsupportedVersion = 0
+
+	if err := persistServiceConfigs(mctx, verifiedSeqno, entry.Entry); err != nil {
+		mctx.Debug("unable to persist paramproofs: %v", err)
+	}
+	return events
+}
+
+// servicesFromConfigs converts parsed ParamProof configs into ServiceTypes,
+// one per config.
+func servicesFromConfigs(mctx libkb.MetaContext, configs []*GenericSocialProofConfig) []libkb.ServiceType {
+	services := make([]libkb.ServiceType, 0, len(configs))
+	for _, config := range configs {
 		services = append(services, NewGenericSocialProofServiceType(config))
 	}
-	p.register(services)
+	return services
 }
 
 type proofServicesT struct {
 	Services []keybase1.ParamProofServiceConfig `json:"services"`
 }
 
-func (p *proofServices) parseServiceConfigs(entry keybase1.MerkleStoreEntry) (res []*GenericSocialProofConfig, err error) {
-	b := []byte(entry.Entry)
+func (p *proofServices) parseServiceConfigs(entry keybase1.MerkleStoreEntry) ([]*GenericSocialProofConfig, error) {
+	return decodeServiceConfigs(libkb.NewMetaContext(context.TODO(), p.G()), []byte(entry.Entry))
+}
+
+// decodeServiceConfigsV1 unmarshals and validates a v1 ParamProof JSON blob.
+// It is registered as the SupportedVersion ParamProofSchema by the init()
+// in paramproof_schema.go, and
+// matches the ParamProofSchema.Parse signature so other schema versions can
+// be registered the same way.
+func decodeServiceConfigsV1(b []byte) (res []*GenericSocialProofConfig, err error) {
 	services := proofServicesT{}
 
 	if err := json.Unmarshal(b, &services); err != nil {
 		return nil, err
 	}
 
-	// Do some basic validation of what we parsed
+	// Do some basic validation of what we parsed. Invalid individual
+	// configs are dropped rather than failing the whole batch.
 	for _, config := range services.Services {
 		validConf, err := NewGenericSocialProofConfig(config)
 		if err != nil {
-			p.G().Log.CDebugf(context.TODO(), "Unable to validate config for %s: %v", config.DisplayName, err)
 			continue
 		}
 		res = append(res, validConf)